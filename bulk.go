@@ -0,0 +1,165 @@
+package epos
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// SetConcurrency controls how many goroutines Bulk* operations fan
+// out over. It defaults to runtime.NumCPU() when never called; n < 1
+// is treated as 1.
+func (c *Collection) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.concurrency = n
+}
+
+func (c *Collection) workers() int {
+	if c.concurrency > 0 {
+		return c.concurrency
+	}
+	return runtime.NumCPU()
+}
+
+// BulkResult is returned, wrapped as the error result of a Bulk*
+// operation, when one or more items failed; it reports every failure
+// rather than collapsing them into a single opaque message. A nil
+// error from a Bulk* call means every item succeeded.
+//
+// A per-item failure never aborts the rest of the batch: every item
+// in the batch is attempted regardless of how many others have
+// already failed, and every failure ends up in Failed rather than
+// short-circuiting the call.
+//
+// Failed is keyed by whatever identifies the item to the caller: for
+// BulkInsert and BulkDelete that's the item's index in the input
+// slice (an int), since that's the only identity a slice element has;
+// for BulkUpdate, whose input is a map, it's keyed by the Id itself -
+// the index a map iterates in carries no meaning a caller could map
+// back to anything.
+type BulkResult struct {
+	Total  int
+	Failed map[interface{}]error
+}
+
+func (r *BulkResult) Error() string {
+	return fmt.Sprintf("bulk operation: %d/%d items failed", len(r.Failed), r.Total)
+}
+
+// BulkInsert inserts every value in values, fanning out over at most
+// c.workers() goroutines at a time. It returns the id assigned to each
+// input, in the same order as values (zero where that item failed),
+// and a *BulkResult error describing any per-item failures; see its
+// doc comment for why a failed item doesn't stop the rest of the
+// batch.
+func (c *Collection) BulkInsert(values []interface{}) ([]Id, error) {
+	n := len(values)
+	ids := make([]Id, n)
+	result := &BulkResult{Total: n, Failed: make(map[interface{}]error)}
+	var mu sync.Mutex
+
+	startId := c.getNextIds(n)
+
+	var g errgroup.Group
+	g.SetLimit(c.workers())
+
+	for i, value := range values {
+		i, value := i, value
+		g.Go(func() error {
+			id := startId + Id(i)
+			jsondata, err := json.Marshal(value)
+			if err == nil {
+				err = c.store.Write(fmt.Sprintf("%d", id), jsondata)
+			}
+			if err != nil {
+				mu.Lock()
+				result.Failed[i] = err
+				mu.Unlock()
+				return nil
+			}
+			ids[i] = id
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return ids, err
+	}
+	if len(result.Failed) > 0 {
+		return ids, result
+	}
+	return ids, nil
+}
+
+// BulkUpdate updates every document named in values, fanning out over
+// at most c.workers() goroutines at a time. It returns a *BulkResult
+// error describing any per-item failures, keyed by Id; see its doc
+// comment for why a failed item doesn't stop the rest of the batch.
+func (c *Collection) BulkUpdate(values map[Id]interface{}) error {
+	result := &BulkResult{Total: len(values), Failed: make(map[interface{}]error)}
+	var mu sync.Mutex
+
+	var g errgroup.Group
+	g.SetLimit(c.workers())
+
+	for id, value := range values {
+		id, value := id, value
+		g.Go(func() error {
+			jsondata, err := json.Marshal(value)
+			if err == nil {
+				err = c.store.Write(fmt.Sprintf("%d", id), jsondata)
+			}
+			if err != nil {
+				mu.Lock()
+				result.Failed[id] = err
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+// BulkDelete deletes every id in ids, fanning out over at most
+// c.workers() goroutines at a time. It returns a *BulkResult error
+// describing any per-item failures; see its doc comment for why a
+// failed item doesn't stop the rest of the batch.
+func (c *Collection) BulkDelete(ids []Id) error {
+	result := &BulkResult{Total: len(ids), Failed: make(map[interface{}]error)}
+	var mu sync.Mutex
+
+	var g errgroup.Group
+	g.SetLimit(c.workers())
+
+	for i, id := range ids {
+		i, id := i, id
+		g.Go(func() error {
+			if err := c.store.Erase(fmt.Sprintf("%d", id)); err != nil {
+				mu.Lock()
+				result.Failed[i] = err
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
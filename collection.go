@@ -3,29 +3,44 @@ package epos
 import (
 	"encoding/binary"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/peterbourgon/diskv"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
 type Collection struct {
 	store     *diskv.Diskv
 	indexpath string
 	indexes   map[string]*index
+
+	// concurrency is the number of workers Bulk* operations fan out
+	// over. Zero, its natural zero value, means "use workers()'s
+	// default" (runtime.NumCPU()) rather than serializing everything.
+	concurrency int
+
+	progress Progress
+}
+
+// SetProgress installs p as the Progress that Reindex, Vacuum and
+// QueryAll report through. It defaults to NoProgress. loadIndexes runs
+// while the collection is being opened, before SetProgress can be
+// called, so the initial index load always reports to NoProgress.
+func (c *Collection) SetProgress(p Progress) {
+	if p == nil {
+		p = NoProgress
+	}
+	c.progress = p
 }
 
 type Id int64
 
+// transformFunc is the sharding scheme ShardLegacyLastFour wraps; see
+// its doc comment.
 func transformFunc(s string) []string {
-	// special case for internal data
-	if s == "_next_id" {
-		return []string{}
-	}
-
 	data := ""
 	if len(s) < 4 {
 		data = fmt.Sprintf("%04s", s)
@@ -36,13 +51,44 @@ func transformFunc(s string) []string {
 	return []string{data[2:4], data[0:2]}
 }
 
-func (db *Database) openColl(name string) *Collection {
-	// create/open collection
+func (db *Database) openColl(name string) (*Collection, error) {
+	return db.openCollWithStrategy(name, nil)
+}
+
+// OpenCollection opens (or creates) the named collection, sharding its
+// on-disk keys with strategy. Pass a nil strategy to get the default:
+// ShardLegacyLastFour for a brand new collection, or whatever strategy
+// was recorded for an existing one. See openCollWithStrategy for what
+// happens when strategy disagrees with what's recorded.
+func (db *Database) OpenCollection(name string, strategy ShardStrategy) (*Collection, error) {
+	return db.openCollWithStrategy(name, strategy)
+}
+
+// openCollWithStrategy opens (or creates) the named collection,
+// sharding its on-disk keys with strategy. strategy only picks the
+// layout when the collection doesn't exist yet, and is then persisted
+// to a collection.meta file so subsequent opens use the same layout; a nil
+// strategy defaults to ShardLegacyLastFour for new collections. If the
+// collection already exists and strategy disagrees with the one
+// recorded in collection.meta, openCollWithStrategy refuses to open it
+// rather than silently reading (or writing) documents under the wrong
+// layout.
+func (db *Database) openCollWithStrategy(name string, strategy ShardStrategy) (*Collection, error) {
+	basePath := db.path + "/colls/" + name
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, err
+	}
+
+	strategy, err := resolveShardStrategy(basePath+"/collection.meta", strategy)
+	if err != nil {
+		return nil, fmt.Errorf("open collection %q: %v", name, err)
+	}
+
 	coll := &Collection{store: diskv.New(diskv.Options{
-		BasePath:     db.path + "/colls/" + name,
-		Transform:    transformFunc,
+		BasePath:     basePath,
+		Transform:    shardTransform(strategy),
 		CacheSizeMax: 0, // no cache
-	}), indexpath: db.path + "/indexes/" + name, indexes: make(map[string]*index}
+	}), indexpath: db.path + "/indexes/" + name, indexes: make(map[string]*index), progress: NoProgress}
 
 	os.Mkdir(coll.indexpath, 0755)
 
@@ -52,26 +98,47 @@ func (db *Database) openColl(name string) *Collection {
 	if _, err := coll.store.Read("_next_id"); err != nil {
 		coll.setNextId(Id(1))
 	}
-	return coll
+	return coll, nil
 }
 
 func (c *Collection) loadIndexes() {
+	var max uint64
+	filepath.Walk(c.indexpath, func(path string, info os.FileInfo, err error) error {
+		if info != nil && (info.Mode()&os.ModeType) == 0 {
+			max++
+		}
+		return nil
+	})
+	c.progress.SetMax(max)
+
 	filepath.Walk(c.indexpath, func(path string, info os.FileInfo, err error) error {
 		if (info.Mode() & os.ModeType) == 0 {
 			if err := c.loadIndex(path, filepath.Base(path)); err != nil {
 				log.Printf("loadIndex %s failed: %v", path, err)
 				// TODO: should we maybe remove or rebuild index?
 			}
+			c.progress.Add(1)
 		}
 		return nil
 	})
+	c.progress.Done()
 }
 
 func (c *Collection) loadIndex(filepath, field string) error {
-	file, err := os.Open(filepath)
+	file, err := os.OpenFile(filepath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	version, headerField, err := readIndexHeader(file)
 	if err != nil {
+		file.Close()
 		return err
 	}
+	if version != 0 && headerField != field {
+		file.Close()
+		return fmt.Errorf("loadIndex: %s header names field %q, expected %q", filepath, headerField, field)
+	}
 
 	idx := newIndex(file, field)
 
@@ -92,6 +159,12 @@ func (c *Collection) loadIndex(filepath, field string) error {
 	}
 
 	c.indexes[field] = idx
+
+	if version == 0 {
+		file.Close()
+		return c.migrateIndexFile(field)
+	}
+
 	return nil
 }
 
@@ -102,9 +175,19 @@ func (c *Collection) setNextId(next_id Id) {
 }
 
 func (c *Collection) getNextId() Id {
+	return c.getNextIds(1)
+}
+
+// getNextIds allocates a contiguous block of n ids with one read and
+// one write of _next_id, returning the first one; the caller owns ids
+// [first, first+n). This is what lets BulkInsert fan out across
+// workers without N separate round-trips through getNextId racing
+// each other. The read and write are not guarded by a lock, so
+// concurrent calls to getNextIds can hand out overlapping blocks.
+func (c *Collection) getNextIds(n int) Id {
 	data, _ := c.store.Read("_next_id")
 	next_id, _ := binary.Varint(data)
-	c.setNextId(Id(next_id + 1))
+	c.setNextId(Id(next_id) + Id(n))
 	return Id(next_id)
 }
 
@@ -132,8 +215,126 @@ func (c *Collection) Update(id Id, value interface{}) error {
 	return c.store.Write(fmt.Sprintf("%d", id), jsondata)
 }
 
+// AddIndex builds an index over field by scanning every document
+// currently in the collection. The index is a snapshot, not a live
+// view: Insert, Update, Bulk* and Delete never touch it, so a document
+// written after AddIndex runs won't be matched by an indexed
+// Equals/GreaterThan until Reindex rebuilds the index. Lookups against
+// an index are filtered through filterExisting so a deleted document's
+// stale entry is at least skipped rather than surfaced as a read error.
 func (c *Collection) AddIndex(field string) error {
-	return errors.New("adding index failed")
+	if _, exists := c.indexes[field]; exists {
+		return fmt.Errorf("index on %q already exists", field)
+	}
+
+	file, err := os.OpenFile(c.indexpath+"/"+field, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := writeIndexHeader(file, field, currentIndexVersion); err != nil {
+		return err
+	}
+
+	idx := newIndex(file, field)
+
+	for key := range c.store.Keys(nil) {
+		if key == "_next_id" {
+			continue
+		}
+		id, err := parseId(key)
+		if err != nil {
+			continue
+		}
+
+		data, err := c.store.Read(key)
+		if err != nil {
+			continue
+		}
+
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			continue
+		}
+
+		value, ok := extractField(doc, field)
+		if !ok {
+			continue
+		}
+
+		entry := newIndexEntry(fieldKey(value), id)
+		fpos, err := file.Seek(0, os.SEEK_END)
+		if err != nil {
+			return err
+		}
+		if _, err := entry.WriteTo(file); err != nil {
+			return err
+		}
+		entry.fpos = fpos
+		idx.Add(entry)
+	}
+
+	c.indexes[field] = idx
+	return nil
+}
+
+// parseId parses a diskv store key back into the Id it was written
+// under by Insert; it rejects internal bookkeeping keys like
+// "_next_id" by simply failing to parse as a number.
+func parseId(key string) (Id, error) {
+	var id int64
+	if _, err := fmt.Sscanf(key, "%d", &id); err != nil {
+		return Id(0), err
+	}
+	return Id(id), nil
+}
+
+// scanIds returns the ids of every document in the collection, for
+// Conditions like True and Not that need the full universe of ids.
+func (c *Collection) scanIds() (idSet, error) {
+	ids := newIdSet()
+	for key := range c.store.Keys(nil) {
+		if key == "_next_id" {
+			continue
+		}
+		id, err := parseId(key)
+		if err != nil {
+			continue
+		}
+		ids[id] = struct{}{}
+	}
+	return ids, nil
+}
+
+// scanMatching full-scans the collection, decoding each document and
+// keeping the ids for which match returns true. It is the fallback a
+// Condition leaf uses when no index covers its field.
+func (c *Collection) scanMatching(match func(doc interface{}) bool) (idSet, error) {
+	ids := newIdSet()
+	for key := range c.store.Keys(nil) {
+		if key == "_next_id" {
+			continue
+		}
+		id, err := parseId(key)
+		if err != nil {
+			continue
+		}
+
+		data, err := c.store.Read(key)
+		if err != nil {
+			continue
+		}
+
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			continue
+		}
+
+		if match(doc) {
+			ids[id] = struct{}{}
+		}
+	}
+	return ids, nil
 }
 
 func (c *Collection) RemoveIndex(field string) error {
@@ -144,26 +345,306 @@ func (c *Collection) RemoveIndex(field string) error {
 	return nil
 }
 
+// Reindex rebuilds field's index by scanning every document currently
+// in the collection - not by streaming the existing index file, which
+// is never read - writing the new index straight to a temporary file
+// and swapping it in once the scan completes. The new in-memory index
+// is built up in full during the scan while the old one stays loaded
+// in c.indexes until the swap, so both are held in RAM at once.
+// Scanning documents rather than the old index is what lets Reindex
+// pick up documents inserted after AddIndex last ran.
 func (c *Collection) Reindex(field string) error {
-	if err := c.RemoveIndex(field); err != nil {
+	return c.ReindexWithOptions(field, VacuumOptions{})
+}
+
+// ReindexWithOptions is Reindex with a progress callback: opts.Progress
+// is called after each document written to the new index, with the
+// running count passed as both scanned and kept. opts.SkipDeletion is
+// ignored.
+func (c *Collection) ReindexWithOptions(field string, opts VacuumOptions) error {
+	path := c.indexpath + "/" + field
+	tmpPath := path + ".reindex"
+
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
 		return err
 	}
-	return c.AddIndex(field)
+
+	if _, err := writeIndexHeader(out, field, currentIndexVersion); err != nil {
+		out.Close()
+		return err
+	}
+
+	idx := newIndex(out, field)
+	scanned := 0
+
+	var max uint64
+	for key := range c.store.Keys(nil) {
+		if key != "_next_id" {
+			max++
+		}
+	}
+	c.progress.SetMax(max)
+
+	for key := range c.store.Keys(nil) {
+		if key == "_next_id" {
+			continue
+		}
+		id, err := parseId(key)
+		if err != nil {
+			continue
+		}
+
+		data, err := c.store.Read(key)
+		if err != nil {
+			continue
+		}
+
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			continue
+		}
+
+		value, ok := extractField(doc, field)
+		if !ok {
+			continue
+		}
+
+		entry := newIndexEntry(fieldKey(value), id)
+		fpos, err := out.Seek(0, os.SEEK_END)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if _, err := entry.WriteTo(out); err != nil {
+			out.Close()
+			return err
+		}
+		entry.fpos = fpos
+		idx.Add(entry)
+
+		scanned++
+		c.progress.Add(1)
+		if opts.Progress != nil {
+			opts.Progress(field, scanned, scanned)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	idx.file = file
+	if old, ok := c.indexes[field]; ok && old.file != nil {
+		old.file.Close()
+	}
+	c.indexes[field] = idx
+	c.progress.Done()
+	return nil
 }
 
+// Delete removes id's document from the store. It does not tombstone
+// or otherwise touch any index entries referencing id; see AddIndex's
+// doc comment for how indexed queries tolerate that.
 func (c *Collection) Delete(id Id) error {
 	return c.store.Erase(fmt.Sprintf("%d", id))
 }
 
+// filterExisting narrows ids down to the ones that still have a
+// document in the store, mirroring the check vacuumIndex already makes
+// per entry. Indexes aren't updated incrementally (see AddIndex), so an
+// index lookup can return ids for documents deleted since the index was
+// built; filtering through store.Has here keeps those out of a Query's
+// results instead of surfacing as a read error from Result.Next.
+func filterExisting(c *Collection, ids []Id) []Id {
+	out := make([]Id, 0, len(ids))
+	for _, id := range ids {
+		if c.store.Has(fmt.Sprintf("%d", id)) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
 func (c *Collection) Query(q Condition) (*Result, error) {
-	return nil, errors.New("query failed")
+	ids, err := q.plan(c)
+	if err != nil {
+		return nil, err
+	}
+	return c.resultOf(ids), nil
+}
+
+// resultOf sorts ids and wraps them in a *Result, the last step shared
+// by every plan(), so Query and QueryAll don't each reimplement it.
+func (c *Collection) resultOf(ids idSet) *Result {
+	ordered := make([]Id, 0, len(ids))
+	for id := range ids {
+		ordered = append(ordered, id)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i] < ordered[j] })
+
+	return newResult(c, ordered)
 }
 
+// QueryAll returns every document in the collection. It calls scanIds
+// directly rather than Query(&True{}), whose plan() would walk the
+// store's key space a second time just to rediscover the same ids
+// QueryAll already needs for its progress max.
 func (c *Collection) QueryAll() (*Result, error) {
-	return c.Query(&True{})
+	ids, err := c.scanIds()
+	if err != nil {
+		return nil, err
+	}
+	c.progress.SetMax(uint64(len(ids)))
+
+	result := c.resultOf(ids)
+	c.progress.Add(uint64(result.Len()))
+	c.progress.Done()
+	return result, nil
+}
+
+// VacuumOptions controls Collection.VacuumWithOptions.
+type VacuumOptions struct {
+	// SkipDeletion turns Vacuum into a dry run: entries that would be
+	// dropped are still reported through Progress, but no index file
+	// is rewritten.
+	SkipDeletion bool
+
+	// Progress, if set, is called after each entry is scanned with
+	// the field being vacuumed and running scanned/kept counts.
+	Progress func(field string, scanned, kept int)
 }
 
+// Vacuum compacts every index in the collection, dropping entries that
+// are tombstoned or whose document id no longer exists in the store.
 func (c *Collection) Vacuum() error {
-	// TODO: clean up indexes
+	return c.VacuumWithOptions(VacuumOptions{})
+}
+
+// VacuumWithOptions is Vacuum with dry-run and progress-reporting
+// support; see VacuumOptions.
+func (c *Collection) VacuumWithOptions(opts VacuumOptions) error {
+	var max uint64
+	for field := range c.indexes {
+		if stat, err := os.Stat(c.indexpath + "/" + field); err == nil {
+			max += uint64(stat.Size())
+		}
+	}
+	c.progress.SetMax(max)
+
+	for field := range c.indexes {
+		if err := c.vacuumIndex(field, opts); err != nil {
+			return err
+		}
+	}
+	c.progress.Done()
+	return nil
+}
+
+// vacuumIndex streams field's index file entry by entry, writing
+// survivors to a sibling temp file and atomically renaming it over the
+// original, so compacting a multi-GB index never holds the whole thing
+// in memory. It reports progress in terms of bytes read from in against
+// the max VacuumWithOptions already set across every index being
+// vacuumed; it does not call SetMax itself.
+func (c *Collection) vacuumIndex(field string, opts VacuumOptions) error {
+	path := c.indexpath + "/" + field
+	in, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, _, err := readIndexHeader(in); err != nil {
+		return err
+	}
+	if headerEnd, err := in.Seek(0, os.SEEK_CUR); err == nil {
+		c.progress.Add(uint64(headerEnd))
+	}
+
+	var out *os.File
+	var idx *index
+	if !opts.SkipDeletion {
+		tmpPath := path + ".vacuum"
+		out, err = os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := writeIndexHeader(out, field, currentIndexVersion); err != nil {
+			out.Close()
+			return err
+		}
+		idx = newIndex(out, field)
+	}
+
+	scanned, kept := 0, 0
+	for {
+		var entry indexEntry
+		n, err := entry.ReadFrom(in)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if out != nil {
+				out.Close()
+			}
+			return err
+		}
+		scanned++
+		c.progress.Add(uint64(n))
+
+		survives := !entry.Deleted() && c.store.Has(fmt.Sprintf("%d", entry.id))
+		if survives {
+			kept++
+			if out != nil {
+				fpos, err := out.Seek(0, os.SEEK_END)
+				if err != nil {
+					out.Close()
+					return err
+				}
+				if _, err := entry.WriteTo(out); err != nil {
+					out.Close()
+					return err
+				}
+				entry.fpos = fpos
+				idx.Add(entry)
+			}
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(field, scanned, kept)
+		}
+	}
+
+	if opts.SkipDeletion {
+		return nil
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := in.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".vacuum", path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	idx.file = file
+	if old, ok := c.indexes[field]; ok && old.file != nil {
+		old.file.Close()
+	}
+	c.indexes[field] = idx
 	return nil
 }
@@ -0,0 +1,262 @@
+package epos
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/peterbourgon/diskv"
+)
+
+// newTestCollection builds a *Collection directly, bypassing Database
+// and its on-disk layout, the way a unit test that only cares about
+// Collection's own behavior should.
+func newTestCollection(t *testing.T) *Collection {
+	t.Helper()
+
+	dir := t.TempDir()
+	indexpath := filepath.Join(dir, "indexes")
+	if err := os.Mkdir(indexpath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Collection{
+		store: diskv.New(diskv.Options{
+			BasePath:     filepath.Join(dir, "colls"),
+			Transform:    shardTransform(ShardFlat{}),
+			CacheSizeMax: 0,
+		}),
+		indexpath: indexpath,
+		indexes:   make(map[string]*index),
+		progress:  NoProgress,
+	}
+	c.setNextId(Id(1))
+	return c
+}
+
+func TestAddIndexQueryRoundTrip(t *testing.T) {
+	c := newTestCollection(t)
+
+	type doc struct {
+		Name string                 `json:"name"`
+		Meta map[string]interface{} `json:"meta"`
+	}
+
+	ids := make([]Id, 3)
+	var err error
+	ids[0], err = c.Insert(doc{Name: "alice", Meta: map[string]interface{}{"role": "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids[1], err = c.Insert(doc{Name: "bob", Meta: map[string]interface{}{"role": "user"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids[2], err = c.Insert(doc{Name: "carol", Meta: map[string]interface{}{"role": "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.AddIndex("name"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddIndex("meta.role"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.Query(&Equals{Field: "name", Value: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Len() != 1 {
+		t.Fatalf("Equals(name, bob): got %d matches, want 1", result.Len())
+	}
+	id, ok, err := result.Next(&doc{})
+	if err != nil || !ok {
+		t.Fatalf("Next: ok=%v err=%v", ok, err)
+	}
+	if id != ids[1] {
+		t.Fatalf("Equals(name, bob): got id %d, want %d", id, ids[1])
+	}
+
+	result, err = c.Query(&Equals{Field: "meta.role", Value: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Len() != 2 {
+		t.Fatalf("Equals(meta.role, admin): got %d matches, want 2", result.Len())
+	}
+}
+
+func TestAddIndexQueryMissesDocumentsInsertedAfter(t *testing.T) {
+	c := newTestCollection(t)
+
+	if _, err := c.Insert(map[string]interface{}{"name": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddIndex("name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Insert(map[string]interface{}{"name": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.Query(&Equals{Field: "name", Value: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Len() != 0 {
+		t.Fatalf("indexed Equals unexpectedly found a document inserted after AddIndex: got %d matches", result.Len())
+	}
+
+	if err := c.Reindex("name"); err != nil {
+		t.Fatal(err)
+	}
+	result, err = c.Query(&Equals{Field: "name", Value: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Len() != 1 {
+		t.Fatalf("after Reindex, Equals(name, bob): got %d matches, want 1", result.Len())
+	}
+}
+
+func TestDeleteFiltersStaleIndexedIds(t *testing.T) {
+	c := newTestCollection(t)
+
+	id, err := c.Insert(map[string]interface{}{"name": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddIndex("name"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.Query(&Equals{Field: "name", Value: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Len() != 0 {
+		t.Fatalf("Equals(name, alice) after Delete: got %d matches, want 0", result.Len())
+	}
+}
+
+func TestIndexFormatMigration(t *testing.T) {
+	c := newTestCollection(t)
+
+	// Hand-write a headerless (v0) index file: two live entries and one
+	// tombstone, written by indexEntry.WriteTo with no header in front.
+	path := filepath.Join(c.indexpath, "name")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []indexEntry{
+		newIndexEntry("alice", Id(1)),
+		newIndexEntry("bob", Id(2)),
+	} {
+		if _, err := e.WriteTo(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := newIndexEntry("carol", Id(3))
+	deleted.deleted = true
+	if _, err := deleted.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := c.IndexFormatVersion("name"); err != nil || v != 0 {
+		t.Fatalf("hand-written index: version=%d err=%v, want version 0", v, err)
+	}
+
+	if err := c.loadIndex(path, "name"); err != nil {
+		t.Fatalf("loadIndex: %v", err)
+	}
+
+	v, err := c.IndexFormatVersion("name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != currentIndexVersion {
+		t.Fatalf("loadIndex should have migrated the file in place: version=%d, want %d", v, currentIndexVersion)
+	}
+
+	idx := c.indexes["name"]
+	if got := idx.Lookup("alice"); len(got) != 1 || got[0] != Id(1) {
+		t.Fatalf("Lookup(alice) after migration = %v, want [1]", got)
+	}
+	if got := idx.Lookup("bob"); len(got) != 1 || got[0] != Id(2) {
+		t.Fatalf("Lookup(bob) after migration = %v, want [2]", got)
+	}
+	if got := idx.Lookup("carol"); len(got) != 0 {
+		t.Fatalf("Lookup(carol) after migration = %v, want none (tombstoned)", got)
+	}
+}
+
+func TestVacuumDropsDeletedIds(t *testing.T) {
+	c := newTestCollection(t)
+
+	id1, err := c.Insert(map[string]interface{}{"name": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := c.Insert(map[string]interface{}{"name": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddIndex("name"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(id1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := c.indexes["name"]
+	if got := idx.Lookup("alice"); len(got) != 0 {
+		t.Fatalf("Vacuum left an entry for a deleted document behind: Lookup(alice) = %v", got)
+	}
+	if got := idx.Lookup("bob"); len(got) != 1 || got[0] != id2 {
+		t.Fatalf("Vacuum dropped a live entry: Lookup(bob) = %v, want [%d]", got, id2)
+	}
+}
+
+func TestResolveShardStrategyRejectsMismatch(t *testing.T) {
+	dir := t.TempDir()
+	metaPath := filepath.Join(dir, "collection.meta")
+
+	if _, err := resolveShardStrategy(metaPath, ShardFlat{}); err != nil {
+		t.Fatalf("resolveShardStrategy on a fresh collection: %v", err)
+	}
+
+	if _, err := resolveShardStrategy(metaPath, ShardByHashPrefix{Bits: 8}); err == nil {
+		t.Fatal("resolveShardStrategy should refuse to reopen with a different strategy than was recorded")
+	}
+
+	if strategy, err := resolveShardStrategy(metaPath, ShardFlat{}); err != nil || strategy.name() != "flat" {
+		t.Fatalf("resolveShardStrategy with the recorded strategy: strategy=%v err=%v", strategy, err)
+	}
+}
+
+func TestResolveShardStrategyRejectsUnsuppliedShardFunc(t *testing.T) {
+	dir := t.TempDir()
+	metaPath := filepath.Join(dir, "collection.meta")
+
+	custom := ShardFunc{Name: "custom", Func: func(s string) []string { return []string{s} }}
+	if _, err := resolveShardStrategy(metaPath, custom); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resolveShardStrategy(metaPath, nil); err == nil {
+		t.Fatal("resolveShardStrategy should refuse to reconstruct a ShardFunc from collection.meta alone")
+	}
+}
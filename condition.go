@@ -0,0 +1,230 @@
+package epos
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Condition is a node in a query expression tree. Query walks a
+// Condition to build an execution plan that prefers available field
+// indexes over full-collection scans.
+type Condition interface {
+	// plan returns the ids of documents in c matching this Condition,
+	// consulting c.indexes where possible and falling back to a full
+	// scan of c's diskv store otherwise.
+	plan(c *Collection) (idSet, error)
+}
+
+// idSet is the intermediate representation a Condition plans into:
+// the set of document ids it matched, before Query loads any document
+// bodies.
+type idSet map[Id]struct{}
+
+func newIdSet(ids ...Id) idSet {
+	s := make(idSet, len(ids))
+	for _, id := range ids {
+		s[id] = struct{}{}
+	}
+	return s
+}
+
+func (s idSet) intersect(other idSet) idSet {
+	out := make(idSet)
+	for id := range s {
+		if _, ok := other[id]; ok {
+			out[id] = struct{}{}
+		}
+	}
+	return out
+}
+
+func (s idSet) union(other idSet) idSet {
+	out := make(idSet, len(s)+len(other))
+	for id := range s {
+		out[id] = struct{}{}
+	}
+	for id := range other {
+		out[id] = struct{}{}
+	}
+	return out
+}
+
+// True matches every document in the collection. QueryAll does not use
+// it; it calls scanIds directly.
+type True struct{}
+
+func (t *True) plan(c *Collection) (idSet, error) {
+	return c.scanIds()
+}
+
+// Not matches every document that Cond does not.
+type Not struct {
+	Cond Condition
+}
+
+func (n *Not) plan(c *Collection) (idSet, error) {
+	all, err := c.scanIds()
+	if err != nil {
+		return nil, err
+	}
+	matched, err := n.Cond.plan(c)
+	if err != nil {
+		return nil, err
+	}
+	out := make(idSet, len(all))
+	for id := range all {
+		if _, ok := matched[id]; !ok {
+			out[id] = struct{}{}
+		}
+	}
+	return out, nil
+}
+
+// And matches documents satisfying every one of Conds. Leaves are
+// planned left to right and intersected as they come in, so an empty
+// intersection short-circuits the remaining leaves.
+type And struct {
+	Conds []Condition
+}
+
+func (a *And) plan(c *Collection) (idSet, error) {
+	if len(a.Conds) == 0 {
+		return newIdSet(), nil
+	}
+
+	result, err := a.Conds[0].plan(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, cond := range a.Conds[1:] {
+		if len(result) == 0 {
+			break
+		}
+		ids, err := cond.plan(c)
+		if err != nil {
+			return nil, err
+		}
+		result = result.intersect(ids)
+	}
+	return result, nil
+}
+
+// Or matches documents satisfying at least one of Conds.
+type Or struct {
+	Conds []Condition
+}
+
+func (o *Or) plan(c *Collection) (idSet, error) {
+	result := newIdSet()
+	for _, cond := range o.Conds {
+		ids, err := cond.plan(c)
+		if err != nil {
+			return nil, err
+		}
+		result = result.union(ids)
+	}
+	return result, nil
+}
+
+// Equals matches documents whose Field equals Value. It uses a field
+// index when AddIndex has built one for Field, and falls back to a
+// full scan otherwise. Index-backed lookups are filtered through
+// filterExisting, since AddIndex's index is a snapshot; see its doc
+// comment.
+type Equals struct {
+	Field string
+	Value interface{}
+}
+
+func (e *Equals) plan(c *Collection) (idSet, error) {
+	key := fieldKey(e.Value)
+	if idx, ok := c.indexes[e.Field]; ok {
+		return newIdSet(filterExisting(c, idx.Lookup(key))...), nil
+	}
+	return c.scanMatching(func(doc interface{}) bool {
+		v, ok := extractField(doc, e.Field)
+		return ok && fieldKey(v) == key
+	})
+}
+
+// GreaterThan matches documents whose Field is greater than Value,
+// comparing numerically when both sides parse as numbers and
+// lexically otherwise. Index-backed lookups are filtered through
+// filterExisting; see AddIndex's doc comment.
+type GreaterThan struct {
+	Field string
+	Value interface{}
+}
+
+func (g *GreaterThan) plan(c *Collection) (idSet, error) {
+	if idx, ok := c.indexes[g.Field]; ok {
+		var ids []Id
+		for _, key := range idx.Keys() {
+			if greaterThan(key, g.Value) {
+				ids = append(ids, idx.Lookup(key)...)
+			}
+		}
+		return newIdSet(filterExisting(c, ids)...), nil
+	}
+	return c.scanMatching(func(doc interface{}) bool {
+		v, ok := extractField(doc, g.Field)
+		return ok && greaterThan(v, g.Value)
+	})
+}
+
+func greaterThan(a, b interface{}) bool {
+	if af, ok := toFloat(a); ok {
+		if bf, ok := toFloat(b); ok {
+			return af > bf
+		}
+	}
+	return fmt.Sprintf("%v", a) > fmt.Sprintf("%v", b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// extractField walks doc, a value produced by json.Unmarshal into
+// interface{}, following the dot-separated components of field into
+// nested objects.
+func extractField(doc interface{}, field string) (interface{}, bool) {
+	cur := doc
+	for _, part := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// fieldKey renders a decoded JSON value into the string form stored in
+// index entries: strings are used as-is, everything else is
+// re-encoded as JSON. A string and a non-string whose JSON text is the
+// same render to the same key, e.g. the number 3 and the string "3".
+func fieldKey(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
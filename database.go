@@ -0,0 +1,20 @@
+package epos
+
+import "os"
+
+// Database is the top-level handle for a directory on disk holding
+// one or more collections, each opened via OpenCollection. It is
+// deliberately thin - path is the only state a Collection needs from
+// it - so that Collection itself stays the type most of this package's
+// logic (and its tests) operate on.
+type Database struct {
+	path string
+}
+
+// Open opens (or creates) a Database rooted at path.
+func Open(path string) (*Database, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return &Database{path: path}, nil
+}
@@ -0,0 +1,163 @@
+package epos
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// indexEntry is a single (field value, document id) mapping persisted
+// in an on-disk index file under indexpath. fpos records the byte
+// offset the entry was read from within its file; it is populated by
+// loadIndex and friends and is never itself serialized.
+type indexEntry struct {
+	key     string
+	id      Id
+	deleted bool
+
+	fpos int64
+}
+
+func newIndexEntry(key string, id Id) indexEntry {
+	return indexEntry{key: key, id: id}
+}
+
+// Deleted reports whether this entry has been tombstoned rather than
+// physically removed from its index file.
+func (e indexEntry) Deleted() bool {
+	return e.deleted
+}
+
+// WriteTo appends e to w in the format ReadFrom expects: a deleted
+// flag byte, a varint-prefixed key, then a varint-encoded document id.
+func (e indexEntry) WriteTo(w io.Writer) (int64, error) {
+	flag := byte(0)
+	if e.deleted {
+		flag = 1
+	}
+	buf := []byte{flag}
+
+	lenbuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenbuf, uint64(len(e.key)))
+	buf = append(buf, lenbuf[:n]...)
+	buf = append(buf, e.key...)
+
+	idbuf := make([]byte, binary.MaxVarintLen64)
+	n = binary.PutVarint(idbuf, int64(e.id))
+	buf = append(buf, idbuf[:n]...)
+
+	written, err := w.Write(buf)
+	return int64(written), err
+}
+
+// ReadFrom reads a single indexEntry written by WriteTo, returning the
+// number of bytes consumed. It reports io.EOF, unwrapped, when r is
+// exhausted exactly at an entry boundary, which is how loadIndex knows
+// it has reached the end of an index file.
+func (e *indexEntry) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+
+	flag := make([]byte, 1)
+	n, err := io.ReadFull(r, flag)
+	total += int64(n)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return total, err
+	}
+
+	keyLen, n, err := readUvarint(r)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	keybuf := make([]byte, keyLen)
+	nr, err := io.ReadFull(r, keybuf)
+	total += int64(nr)
+	if err != nil {
+		return total, err
+	}
+
+	id, n, err := readVarint(r)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	e.deleted = flag[0] != 0
+	e.key = string(keybuf)
+	e.id = Id(id)
+	return total, nil
+}
+
+func readUvarint(r io.Reader) (uint64, int, error) {
+	var x uint64
+	var s uint
+	one := make([]byte, 1)
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		if _, err := io.ReadFull(r, one); err != nil {
+			return 0, i, err
+		}
+		b := one[0]
+		if b < 0x80 {
+			return x | uint64(b)<<s, i + 1, nil
+		}
+		x |= uint64(b&0x7f) << s
+		s += 7
+	}
+	return 0, binary.MaxVarintLen64, errors.New("epos: varint overflow reading index entry")
+}
+
+func readVarint(r io.Reader) (int64, int, error) {
+	ux, n, err := readUvarint(r)
+	if err != nil {
+		return 0, n, err
+	}
+	x := int64(ux >> 1)
+	if ux&1 != 0 {
+		x = ^x
+	}
+	return x, n, nil
+}
+
+// index is the in-memory view of a single field's on-disk index file:
+// a multimap from the field's encoded value to the ids of documents
+// holding that value, plus the open file new entries are appended to.
+type index struct {
+	field   string
+	file    *os.File
+	entries map[string][]Id
+}
+
+func newIndex(file *os.File, field string) *index {
+	return &index{
+		field:   field,
+		file:    file,
+		entries: make(map[string][]Id),
+	}
+}
+
+// Add records entry in the in-memory index. It does not write entry to
+// disk; callers that want entry persisted write it themselves and call
+// Add once the write succeeds, mirroring loadIndex.
+func (idx *index) Add(entry indexEntry) {
+	idx.entries[entry.key] = append(idx.entries[entry.key], entry.id)
+}
+
+// Lookup returns the ids of documents whose indexed field equals key.
+func (idx *index) Lookup(key string) []Id {
+	return idx.entries[key]
+}
+
+// Keys returns every distinct value currently recorded in the index,
+// in no particular order.
+func (idx *index) Keys() []string {
+	keys := make([]string, 0, len(idx.entries))
+	for k := range idx.entries {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,180 @@
+package epos
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// indexMagic identifies a versioned (v1+) index file. Files written
+// before this format existed (v0) have no header at all and start
+// straight in with indexEntry records, which is how readIndexHeader
+// tells the two apart.
+const indexMagic = "EPIX"
+
+// currentIndexVersion is the format version written by every index
+// file new code creates; readIndexHeader and loadIndex understand
+// every version from v0 up to this one.
+const currentIndexVersion uint16 = 1
+
+// writeIndexHeader writes the v1+ header to the start of w: the magic
+// bytes, a big-endian version, then a varint-prefixed field name. It
+// reserves the version field for future changes to indexEntry's
+// layout (a different key encoding, a per-entry checksum, ...).
+func writeIndexHeader(w io.Writer, field string, version uint16) (int64, error) {
+	buf := []byte(indexMagic)
+
+	verbuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(verbuf, version)
+	buf = append(buf, verbuf...)
+
+	lenbuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenbuf, uint64(len(field)))
+	buf = append(buf, lenbuf[:n]...)
+	buf = append(buf, field...)
+
+	written, err := w.Write(buf)
+	return int64(written), err
+}
+
+// readIndexHeader reads a v1+ header from the start of file. If file
+// doesn't begin with indexMagic, it's a headerless v0 file: file is
+// rewound to the beginning and readIndexHeader returns version 0 so
+// the caller can read indexEntry records directly from offset 0.
+func readIndexHeader(file *os.File) (version uint16, field string, err error) {
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return 0, "", err
+	}
+
+	magic := make([]byte, len(indexMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil || string(magic[:n]) != indexMagic {
+		if _, serr := file.Seek(0, os.SEEK_SET); serr != nil {
+			return 0, "", serr
+		}
+		return 0, "", nil
+	}
+
+	verbuf := make([]byte, 2)
+	if _, err := io.ReadFull(file, verbuf); err != nil {
+		return 0, "", err
+	}
+	version = binary.BigEndian.Uint16(verbuf)
+
+	fieldLen, _, err := readUvarint(file)
+	if err != nil {
+		return 0, "", err
+	}
+	fieldbuf := make([]byte, fieldLen)
+	if _, err := io.ReadFull(file, fieldbuf); err != nil {
+		return 0, "", err
+	}
+
+	return version, string(fieldbuf), nil
+}
+
+// IndexFormatVersion returns the on-disk format version of field's
+// index file without loading any of its entries.
+func (c *Collection) IndexFormatVersion(field string) (uint16, error) {
+	file, err := os.Open(c.indexpath + "/" + field)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	version, _, err := readIndexHeader(file)
+	return version, err
+}
+
+// MigrateIndexes rewrites every index loaded into this collection that
+// is still in the legacy headerless (v0) format to the current
+// versioned format. It covers this one collection only, not the whole
+// database, and skips index files that are not in c.indexes. loadIndex
+// already migrates each v0 file as the collection is opened, so
+// MigrateIndexes only finds work where that migration failed.
+func (c *Collection) MigrateIndexes() error {
+	for field := range c.indexes {
+		version, err := c.IndexFormatVersion(field)
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			if err := c.migrateIndexFile(field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateIndexFile rewrites the on-disk index for field from the
+// headerless v0 format into the current versioned format, preserving
+// every entry, tombstones included, so the migration changes nothing
+// but the on-disk layout.
+func (c *Collection) migrateIndexFile(field string) error {
+	path := c.indexpath + "/" + field
+
+	old, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	version, _, err := readIndexHeader(old)
+	if err != nil {
+		old.Close()
+		return err
+	}
+	if version != 0 {
+		old.Close()
+		return fmt.Errorf("migrateIndexFile: %s is already at version %d", path, version)
+	}
+
+	tmpPath := path + ".migrate"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		old.Close()
+		return err
+	}
+
+	if _, err := writeIndexHeader(out, field, currentIndexVersion); err != nil {
+		old.Close()
+		out.Close()
+		return err
+	}
+
+	for {
+		var entry indexEntry
+		if _, err := entry.ReadFrom(old); err != nil {
+			if err == io.EOF {
+				break
+			}
+			old.Close()
+			out.Close()
+			return err
+		}
+		if _, err := entry.WriteTo(out); err != nil {
+			old.Close()
+			out.Close()
+			return err
+		}
+	}
+
+	old.Close()
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if idx, ok := c.indexes[field]; ok {
+		idx.file = file
+	} else {
+		file.Close()
+	}
+	return nil
+}
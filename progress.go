@@ -0,0 +1,22 @@
+package epos
+
+// Progress reports on a long-running Collection operation such as
+// loadIndexes or Vacuum: SetMax announces the total amount of work up
+// front (once it's known), Add reports incremental completion, and
+// Done marks the operation finished.
+type Progress interface {
+	SetMax(uint64)
+	Add(uint64)
+	Done()
+}
+
+type noopProgress struct{}
+
+func (noopProgress) SetMax(uint64) {}
+func (noopProgress) Add(uint64)    {}
+func (noopProgress) Done()         {}
+
+// NoProgress is the Progress every Collection uses until SetProgress
+// is called: every method is a no-op, so existing callers that don't
+// care about progress reporting are unaffected.
+var NoProgress Progress = noopProgress{}
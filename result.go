@@ -0,0 +1,48 @@
+package epos
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Result is a lazily-evaluated view over the ids a Query matched.
+// Documents are only read from the collection's diskv store as the
+// caller advances through Next, so a Query over a large collection
+// never materializes every matching document at once.
+type Result struct {
+	coll *Collection
+	ids  []Id
+	pos  int
+}
+
+func newResult(c *Collection, ids []Id) *Result {
+	return &Result{coll: c, ids: ids}
+}
+
+// Next decodes the next matching document into v, in the same way
+// json.Unmarshal would, and returns its Id. The returned bool is false
+// once every match has been consumed, at which point v is left
+// untouched.
+func (r *Result) Next(v interface{}) (Id, bool, error) {
+	if r.pos >= len(r.ids) {
+		return Id(0), false, nil
+	}
+
+	id := r.ids[r.pos]
+	r.pos++
+
+	data, err := r.coll.store.Read(fmt.Sprintf("%d", id))
+	if err != nil {
+		return id, true, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return id, true, err
+	}
+	return id, true, nil
+}
+
+// Len returns the number of matching ids without reading any
+// documents.
+func (r *Result) Len() int {
+	return len(r.ids)
+}
@@ -0,0 +1,183 @@
+package epos
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ShardStrategy maps a store key to the nested directory components
+// diskv should place it under. It replaces the old hard-coded
+// transformFunc, which bucketed keys by the last four characters of
+// the decimal id and piled every id ending in the same two digits into
+// one directory once a collection passed ~10k documents.
+type ShardStrategy interface {
+	// Shard returns the directory components key should be stored
+	// under.
+	Shard(key string) []string
+
+	// name identifies the strategy for persistence in collection.meta
+	// and must round-trip through parseShardStrategy.
+	name() string
+}
+
+// ShardFlat stores every key directly in the collection's base
+// directory, with no subdirectories. It suits small collections where
+// sharding would only waste inodes.
+type ShardFlat struct{}
+
+func (ShardFlat) Shard(key string) []string { return []string{} }
+func (ShardFlat) name() string              { return "flat" }
+
+// ShardByHashPrefix shards keys by the leading hex digits of the
+// 32-bit FNV-1a hash of key, one digit per path component. Bits is
+// rounded up to whole hex digits (4 bits each), with at least one
+// and at most eight components - similar to how
+// content-addressed stores like restic shard pack files by the first
+// two hex characters of their hash.
+type ShardByHashPrefix struct {
+	Bits int
+}
+
+func (s ShardByHashPrefix) Shard(key string) []string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	hexSum := fmt.Sprintf("%08x", h.Sum32())
+
+	hexDigits := (s.Bits + 3) / 4
+	if hexDigits < 1 {
+		hexDigits = 1
+	}
+	if hexDigits > len(hexSum) {
+		hexDigits = len(hexSum)
+	}
+
+	components := make([]string, hexDigits)
+	for i := 0; i < hexDigits; i++ {
+		components[i] = string(hexSum[i])
+	}
+	return components
+}
+
+func (s ShardByHashPrefix) name() string {
+	return fmt.Sprintf("hash:%d", s.Bits)
+}
+
+// ShardLegacyLastFour reproduces the pre-ShardStrategy default:
+// bucketing by the last four characters of a decimal id. It exists so
+// collections created before ShardStrategy existed keep opening the
+// same way; new collections should prefer ShardByHashPrefix or
+// ShardFlat.
+type ShardLegacyLastFour struct{}
+
+func (ShardLegacyLastFour) Shard(key string) []string { return transformFunc(key) }
+func (ShardLegacyLastFour) name() string              { return "legacy4" }
+
+// ShardFunc adapts a plain func(string) []string into a ShardStrategy
+// for callers with a bespoke layout. Name identifies the strategy in
+// collection.meta, so two ShardFuncs with different Func values but
+// the same Name are (by convention) expected to shard identically.
+type ShardFunc struct {
+	Name string
+	Func func(string) []string
+}
+
+func (s ShardFunc) Shard(key string) []string { return s.Func(key) }
+func (s ShardFunc) name() string              { return "func:" + s.Name }
+
+// parseShardStrategy recovers a ShardStrategy persisted in a
+// collection.meta file from its name. It only handles names whose
+// sharding can be reproduced from the name alone; a "func:"-prefixed
+// name (a ShardFunc) can't be reconstructed this way, since its Func
+// field isn't persisted, and is rejected as unknown so callers don't
+// end up with a ShardFunc whose Func is nil. resolveShardStrategy
+// handles "func:" names specially, by requiring the caller to supply
+// a matching ShardFunc, rather than going through parseShardStrategy.
+func parseShardStrategy(s string) (ShardStrategy, error) {
+	switch s {
+	case "flat":
+		return ShardFlat{}, nil
+	case "legacy4":
+		return ShardLegacyLastFour{}, nil
+	}
+
+	var bits int
+	if _, err := fmt.Sscanf(s, "hash:%d", &bits); err == nil {
+		return ShardByHashPrefix{Bits: bits}, nil
+	}
+
+	return nil, fmt.Errorf("unknown shard strategy %q", s)
+}
+
+// readShardMetaName reads the raw shard strategy name recorded in the
+// collection.meta file at path. It returns an *os.PathError satisfying
+// os.IsNotExist when the collection (and so the meta file) doesn't
+// exist yet.
+func readShardMetaName(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// writeShardMeta persists strategy's name to the collection.meta file
+// at path, creating it if necessary.
+func writeShardMeta(path string, strategy ShardStrategy) error {
+	return ioutil.WriteFile(path, []byte(strategy.name()), 0644)
+}
+
+// resolveShardStrategy determines which ShardStrategy the collection
+// whose meta file lives at metaPath should use, creating that meta
+// file (recording requested, or ShardLegacyLastFour if requested is
+// nil) if the collection doesn't exist yet.
+//
+// If the collection already exists and requested is non-nil, its name
+// must match what's recorded or resolveShardStrategy errors rather
+// than silently opening the store under a different layout. If
+// requested is nil, the recorded strategy is reconstructed from its
+// name via parseShardStrategy - except when it was recorded as a
+// ShardFunc, which parseShardStrategy can't safely rebuild (the Func
+// field isn't persisted); reopening such a collection requires the
+// caller to pass the same ShardFunc explicitly.
+func resolveShardStrategy(metaPath string, requested ShardStrategy) (ShardStrategy, error) {
+	recordedName, err := readShardMetaName(metaPath)
+	switch {
+	case err == nil:
+		if requested != nil {
+			if requested.name() != recordedName {
+				return nil, fmt.Errorf("collection was created with shard strategy %q, cannot open with %q", recordedName, requested.name())
+			}
+			return requested, nil
+		}
+		if strings.HasPrefix(recordedName, "func:") {
+			return nil, fmt.Errorf("collection was created with a custom ShardFunc (%s); reopen must pass the same ShardStrategy explicitly", recordedName)
+		}
+		return parseShardStrategy(recordedName)
+	case os.IsNotExist(err):
+		strategy := requested
+		if strategy == nil {
+			strategy = ShardLegacyLastFour{}
+		}
+		if err := writeShardMeta(metaPath, strategy); err != nil {
+			return nil, err
+		}
+		return strategy, nil
+	default:
+		return nil, err
+	}
+}
+
+// shardTransform adapts strategy into a diskv.TransformFunction,
+// keeping the "_next_id" bookkeeping key unsharded regardless of
+// strategy.
+func shardTransform(strategy ShardStrategy) func(string) []string {
+	return func(s string) []string {
+		if s == "_next_id" {
+			return []string{}
+		}
+		return strategy.Shard(s)
+	}
+}
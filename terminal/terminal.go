@@ -0,0 +1,36 @@
+// Package terminal provides a simple epos.Progress implementation for
+// CLI tools: it prints a running counter to stdout as an operation
+// progresses.
+package terminal
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Progress prints label and a running count/max to stdout every time
+// Add is called, and a final summary on Done. It satisfies
+// epos.Progress.
+type Progress struct {
+	label   string
+	max     uint64
+	current uint64
+}
+
+// New returns a Progress that prefixes its output with label.
+func New(label string) *Progress {
+	return &Progress{label: label}
+}
+
+func (p *Progress) SetMax(max uint64) {
+	atomic.StoreUint64(&p.max, max)
+}
+
+func (p *Progress) Add(n uint64) {
+	current := atomic.AddUint64(&p.current, n)
+	fmt.Printf("\r%s: %d/%d", p.label, current, atomic.LoadUint64(&p.max))
+}
+
+func (p *Progress) Done() {
+	fmt.Printf("\r%s: done (%d items)\n", p.label, atomic.LoadUint64(&p.current))
+}